@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"math"
+	"math/bits"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// DedupConfig controls how aggressively near-duplicate or re-posted
+// stories reuse a previously generated image instead of calling Gemini
+// again.
+type DedupConfig struct {
+	TitleSim  float64
+	PHashDist int
+}
+
+const (
+	defaultDedupTitleSim  = 0.82
+	defaultDedupPHashDist = 4
+)
+
+// DedupConfigFromEnv reads DEDUP_TITLE_SIM and DEDUP_PHASH_DIST, falling
+// back to conservative defaults that only reuse images for near-identical
+// titles or visually near-identical art.
+func DedupConfigFromEnv() DedupConfig {
+	cfg := DedupConfig{TitleSim: defaultDedupTitleSim, PHashDist: defaultDedupPHashDist}
+
+	if v := os.Getenv("DEDUP_TITLE_SIM"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			cfg.TitleSim = f
+		}
+	}
+	if v := os.Getenv("DEDUP_PHASH_DIST"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.PHashDist = n
+		}
+	}
+
+	return cfg
+}
+
+// ImageHashes holds the three perceptual hashes computed for a generated
+// image.
+type ImageHashes struct {
+	AHash uint64
+	DHash uint64
+	PHash uint64
+}
+
+// HashEntry is one row of the hash index: a generated image's hashes plus
+// the story title and cacheID it was generated for.
+type HashEntry struct {
+	CacheID int    `json:"cacheId"`
+	Title   string `json:"title"`
+	AHash   uint64 `json:"aHash"`
+	DHash   uint64 `json:"dHash"`
+	PHash   uint64 `json:"pHash"`
+}
+
+// HashIndex is a JSON-backed index of every image generated so far, used to
+// find images that can be reused for a new story instead of calling Gemini
+// again. pHash lookups are accelerated by bucketing each of its 8 bytes
+// independently, so a candidate only needs a full Hamming comparison if it
+// shares at least one byte with the query hash.
+type HashIndex struct {
+	mu      sync.Mutex
+	path    string
+	Entries []HashEntry `json:"entries"`
+	buckets [8]map[byte][]int
+}
+
+// LoadHashIndex reads the index from disk, or returns an empty index if it
+// doesn't exist yet.
+func LoadHashIndex(path string) (*HashIndex, error) {
+	idx := &HashIndex{path: path}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			idx.rebuildBuckets()
+			return idx, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &idx.Entries); err != nil {
+		return nil, err
+	}
+	idx.rebuildBuckets()
+
+	return idx, nil
+}
+
+func (idx *HashIndex) rebuildBuckets() {
+	for i := range idx.buckets {
+		idx.buckets[i] = make(map[byte][]int)
+	}
+	for pos, entry := range idx.Entries {
+		idx.bucketEntry(pos, entry)
+	}
+}
+
+func (idx *HashIndex) bucketEntry(pos int, entry HashEntry) {
+	for b := 0; b < 8; b++ {
+		key := byte(entry.PHash >> uint(b*8))
+		idx.buckets[b][key] = append(idx.buckets[b][key], pos)
+	}
+}
+
+// candidates returns index positions that share at least one byte of their
+// pHash with the query, deduplicated.
+func (idx *HashIndex) candidates(pHash uint64) []int {
+	seen := make(map[int]bool)
+	var out []int
+	for b := 0; b < 8; b++ {
+		key := byte(pHash >> uint(b*8))
+		for _, pos := range idx.buckets[b][key] {
+			if !seen[pos] {
+				seen[pos] = true
+				out = append(out, pos)
+			}
+		}
+	}
+	return out
+}
+
+// FindByPHash returns the closest entry within maxDist Hamming distance of
+// pHash, if any.
+func (idx *HashIndex) FindByPHash(pHash uint64, maxDist int) (HashEntry, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	best := -1
+	bestDist := maxDist + 1
+	for _, pos := range idx.candidates(pHash) {
+		dist := bits.OnesCount64(idx.Entries[pos].PHash ^ pHash)
+		if dist <= maxDist && dist < bestDist {
+			best, bestDist = pos, dist
+		}
+	}
+
+	if best == -1 {
+		return HashEntry{}, false
+	}
+	return idx.Entries[best], true
+}
+
+// FindByTitle returns the entry whose title is most similar to title, if
+// its similarity meets minSim.
+func (idx *HashIndex) FindByTitle(title string, minSim float64) (HashEntry, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	best := -1
+	bestSim := minSim
+	for i, entry := range idx.Entries {
+		if sim := titleSimilarity(title, entry.Title); sim >= bestSim {
+			best, bestSim = i, sim
+		}
+	}
+
+	if best == -1 {
+		return HashEntry{}, false
+	}
+	return idx.Entries[best], true
+}
+
+// Add appends entry to the index and persists it to disk. The write runs
+// under the same lock as the mutation so concurrent Add calls (Render now
+// fans out story rendering) can't race to disk and have a later-finishing
+// writer with an earlier, smaller snapshot clobber an entry another
+// goroutine already added.
+func (idx *HashIndex) Add(entry HashEntry) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.bucketEntry(len(idx.Entries), entry)
+	idx.Entries = append(idx.Entries, entry)
+
+	data, err := json.MarshalIndent(idx.Entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(idx.path, data, 0644)
+}
+
+// computeHashesFromBytes decodes raw image bytes and computes its aHash,
+// dHash, and pHash.
+func computeHashesFromBytes(raw []byte) (ImageHashes, error) {
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return ImageHashes{}, err
+	}
+	return computeHashes(img)
+}
+
+func computeHashes(img image.Image) (ImageHashes, error) {
+	aHash, err := averageHash(img)
+	if err != nil {
+		return ImageHashes{}, err
+	}
+	dHash, err := differenceHash(img)
+	if err != nil {
+		return ImageHashes{}, err
+	}
+	pHash, err := perceptualHash(img)
+	if err != nil {
+		return ImageHashes{}, err
+	}
+	return ImageHashes{AHash: aHash, DHash: dHash, PHash: pHash}, nil
+}
+
+// grayPixels resizes img to w x h and returns its grayscale luminance
+// values in row-major order, reusing the same Resize/Grayscale filters the
+// e-ink pipeline uses.
+func grayPixels(img image.Image, w, h int) ([]float64, error) {
+	resized, err := (ResizeFilter{Width: w, Height: h}).Apply(img)
+	if err != nil {
+		return nil, err
+	}
+	grayImg, err := (GrayscaleFilter{}).Apply(resized)
+	if err != nil {
+		return nil, err
+	}
+
+	gray := grayImg.(*image.Gray)
+	pixels := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			pixels[y*w+x] = float64(gray.GrayAt(x, y).Y)
+		}
+	}
+	return pixels, nil
+}
+
+// averageHash sets a bit for every pixel in an 8x8 thumbnail that's at or
+// above the thumbnail's mean brightness.
+func averageHash(img image.Image) (uint64, error) {
+	pixels, err := grayPixels(img, 8, 8)
+	if err != nil {
+		return 0, err
+	}
+
+	var sum float64
+	for _, p := range pixels {
+		sum += p
+	}
+	mean := sum / float64(len(pixels))
+
+	var hash uint64
+	for i, p := range pixels {
+		if p >= mean {
+			hash |= 1 << uint(63-i)
+		}
+	}
+	return hash, nil
+}
+
+// differenceHash sets a bit for every pixel in a 9x8 thumbnail that's
+// darker than its right-hand neighbor.
+func differenceHash(img image.Image) (uint64, error) {
+	pixels, err := grayPixels(img, 9, 8)
+	if err != nil {
+		return 0, err
+	}
+
+	var hash uint64
+	idx := 0
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if pixels[y*9+x] < pixels[y*9+x+1] {
+				hash |= 1 << uint(63-idx)
+			}
+			idx++
+		}
+	}
+	return hash, nil
+}
+
+// perceptualHash reduces img to a 32x32 grayscale thumbnail, runs a 2D
+// DCT-II over it, and sets a bit for each of the 64 lowest-frequency
+// coefficients that's above their median.
+func perceptualHash(img image.Image) (uint64, error) {
+	const size = 32
+
+	pixels, err := grayPixels(img, size, size)
+	if err != nil {
+		return 0, err
+	}
+
+	matrix := make([][]float64, size)
+	for y := 0; y < size; y++ {
+		matrix[y] = pixels[y*size : (y+1)*size]
+	}
+
+	coeffs := dct2D(matrix)
+
+	lowFreq := make([]float64, 0, 64)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			lowFreq = append(lowFreq, coeffs[y][x])
+		}
+	}
+
+	sorted := append([]float64(nil), lowFreq...)
+	sort.Float64s(sorted)
+	median := (sorted[31] + sorted[32]) / 2
+
+	var hash uint64
+	for i, v := range lowFreq {
+		if v > median {
+			hash |= 1 << uint(63-i)
+		}
+	}
+	return hash, nil
+}
+
+// dct1D runs a 1-dimensional DCT-II over input.
+func dct1D(input []float64) []float64 {
+	n := len(input)
+	output := make([]float64, n)
+
+	for u := 0; u < n; u++ {
+		var sum float64
+		for x := 0; x < n; x++ {
+			sum += input[x] * math.Cos(math.Pi/float64(n)*(float64(x)+0.5)*float64(u))
+		}
+		cu := 1.0
+		if u == 0 {
+			cu = 1.0 / math.Sqrt2
+		}
+		output[u] = sum * cu * math.Sqrt(2.0/float64(n))
+	}
+
+	return output
+}
+
+// dct2D runs the 1D DCT-II over every row, then every column.
+func dct2D(matrix [][]float64) [][]float64 {
+	n := len(matrix)
+
+	rows := make([][]float64, n)
+	for y := range matrix {
+		rows[y] = dct1D(matrix[y])
+	}
+
+	result := make([][]float64, n)
+	for y := range result {
+		result[y] = make([]float64, n)
+	}
+	for x := 0; x < n; x++ {
+		col := make([]float64, n)
+		for y := 0; y < n; y++ {
+			col[y] = rows[y][x]
+		}
+		col = dct1D(col)
+		for y := 0; y < n; y++ {
+			result[y][x] = col[y]
+		}
+	}
+
+	return result
+}
+
+// normalizeTitleTokens lowercases a title, strips punctuation, and splits
+// it into words.
+func normalizeTitleTokens(title string) []string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(title) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == ' ' {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune(' ')
+		}
+	}
+	return strings.Fields(b.String())
+}
+
+func toSet(items []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(items))
+	for _, item := range items {
+		set[item] = struct{}{}
+	}
+	return set
+}
+
+func jaccard(a, b map[string]struct{}) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+
+	intersection := 0
+	for k := range a {
+		if _, ok := b[k]; ok {
+			intersection++
+		}
+	}
+
+	union := len(a) + len(b) - intersection
+	if union == 0 {
+		return 0
+	}
+	return float64(intersection) / float64(union)
+}
+
+// trigrams returns the set of 3-character substrings of s.
+func trigrams(s string) map[string]struct{} {
+	set := make(map[string]struct{})
+	if len(s) < 3 {
+		if s != "" {
+			set[s] = struct{}{}
+		}
+		return set
+	}
+	for i := 0; i+3 <= len(s); i++ {
+		set[s[i:i+3]] = struct{}{}
+	}
+	return set
+}
+
+// titleSimilarity averages normalized token overlap and character-trigram
+// similarity between two story titles, so both "Show HN: X" reposts and
+// reworded follow-ups are caught.
+func titleSimilarity(a, b string) float64 {
+	tokensA := normalizeTitleTokens(a)
+	tokensB := normalizeTitleTokens(b)
+
+	tokenSim := jaccard(toSet(tokensA), toSet(tokensB))
+	trigramSim := jaccard(trigrams(strings.Join(tokensA, " ")), trigrams(strings.Join(tokensB, " ")))
+
+	return (tokenSim + trigramSim) / 2
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"math/bits"
+	"sync"
+	"testing"
+)
+
+// encodePNG is a small helper so hash-function tests can go through the same
+// computeHashesFromBytes decode path main.go uses on real Gemini output.
+func encodePNG(t *testing.T, img *image.RGBA) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("png.Encode: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func checkerImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if (x+y)%2 == 0 {
+				img.Set(x, y, color.RGBA{A: 255})
+			} else {
+				img.Set(x, y, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+			}
+		}
+	}
+	return img
+}
+
+func TestComputeHashesFromBytesDecodesRealImage(t *testing.T) {
+	raw := encodePNG(t, solidImage(64, 64, color.RGBA{R: 10, G: 20, B: 30, A: 255}))
+
+	hashes, err := computeHashesFromBytes(raw)
+	if err != nil {
+		t.Fatalf("computeHashesFromBytes: %v", err)
+	}
+	if hashes == (ImageHashes{}) {
+		t.Error("computeHashesFromBytes returned an all-zero ImageHashes for a real PNG")
+	}
+}
+
+func TestComputeHashesIdenticalForIdenticalImages(t *testing.T) {
+	a := solidImage(64, 64, color.RGBA{R: 200, G: 30, B: 30, A: 255})
+	b := solidImage(64, 64, color.RGBA{R: 200, G: 30, B: 30, A: 255})
+
+	hashesA, err := computeHashes(a)
+	if err != nil {
+		t.Fatalf("computeHashes(a): %v", err)
+	}
+	hashesB, err := computeHashes(b)
+	if err != nil {
+		t.Fatalf("computeHashes(b): %v", err)
+	}
+
+	if hashesA != hashesB {
+		t.Errorf("computeHashes differ for pixel-identical images: %+v vs %+v", hashesA, hashesB)
+	}
+}
+
+func TestComputeHashesDistinguishDifferentImages(t *testing.T) {
+	solid := solidImage(64, 64, color.RGBA{R: 200, G: 30, B: 30, A: 255})
+	checker := checkerImage(64, 64)
+
+	solidHashes, err := computeHashes(solid)
+	if err != nil {
+		t.Fatalf("computeHashes(solid): %v", err)
+	}
+	checkerHashes, err := computeHashes(checker)
+	if err != nil {
+		t.Fatalf("computeHashes(checker): %v", err)
+	}
+
+	if dist := bits.OnesCount64(solidHashes.PHash ^ checkerHashes.PHash); dist < defaultDedupPHashDist {
+		t.Errorf("pHash Hamming distance between a solid color and a checkerboard = %d, want >= %d", dist, defaultDedupPHashDist)
+	}
+}
+
+func TestDifferenceHashDistinguishesGradientDirection(t *testing.T) {
+	leftToRight := image.NewRGBA(image.Rect(0, 0, 9, 8))
+	rightToLeft := image.NewRGBA(image.Rect(0, 0, 9, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 9; x++ {
+			v := uint8(x * 28)
+			leftToRight.Set(x, y, color.RGBA{R: v, G: v, B: v, A: 255})
+			rightToLeft.Set(x, y, color.RGBA{R: 255 - v, G: 255 - v, B: 255 - v, A: 255})
+		}
+	}
+
+	hashLTR, err := differenceHash(leftToRight)
+	if err != nil {
+		t.Fatalf("differenceHash(leftToRight): %v", err)
+	}
+	hashRTL, err := differenceHash(rightToLeft)
+	if err != nil {
+		t.Fatalf("differenceHash(rightToLeft): %v", err)
+	}
+
+	if hashLTR == hashRTL {
+		t.Error("differenceHash identical for opposite gradient directions")
+	}
+	// Every bit should flip, since every neighbor comparison flips direction.
+	if dist := bits.OnesCount64(hashLTR ^ hashRTL); dist != 64 {
+		t.Errorf("differenceHash Hamming distance between inverted gradients = %d, want 64", dist)
+	}
+}
+
+func TestFindByPHashReturnsClosestWithinDistance(t *testing.T) {
+	idx := &HashIndex{path: t.TempDir() + "/hashindex.db"}
+	idx.rebuildBuckets()
+
+	solid := solidImage(64, 64, color.RGBA{R: 200, G: 30, B: 30, A: 255})
+	solidHashes, err := computeHashes(solid)
+	if err != nil {
+		t.Fatalf("computeHashes(solid): %v", err)
+	}
+	checkerHashes, err := computeHashes(checkerImage(64, 64))
+	if err != nil {
+		t.Fatalf("computeHashes(checker): %v", err)
+	}
+
+	if err := idx.Add(HashEntry{CacheID: 1, Title: "solid", AHash: solidHashes.AHash, DHash: solidHashes.DHash, PHash: solidHashes.PHash}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := idx.Add(HashEntry{CacheID: 2, Title: "checker", AHash: checkerHashes.AHash, DHash: checkerHashes.DHash, PHash: checkerHashes.PHash}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	entry, ok := idx.FindByPHash(solidHashes.PHash, defaultDedupPHashDist)
+	if !ok {
+		t.Fatal("FindByPHash found no match for an exact duplicate's pHash")
+	}
+	if entry.CacheID != 1 {
+		t.Errorf("FindByPHash matched cacheID %d, want 1 (the solid-color entry)", entry.CacheID)
+	}
+
+	if _, ok := idx.FindByPHash(solidHashes.PHash, 0); !ok {
+		t.Error("FindByPHash(dist=0) should still match an exact duplicate")
+	}
+}
+
+func TestTitleSimilarity(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    string
+		wantMin float64
+		wantMax float64
+	}{
+		{name: "identical", a: "Show HN: My new database", b: "Show HN: My new database", wantMin: 1, wantMax: 1},
+		{name: "show hn repost", a: "Show HN: My new database", b: "My new database", wantMin: 0.6, wantMax: 1},
+		{name: "reworded follow-up", a: "Why Rust is great for systems programming", b: "Why Rust is great for systems work", wantMin: 0.5, wantMax: 1},
+		{name: "unrelated", a: "Launch HN: A new database", b: "The history of the bicycle", wantMin: 0, wantMax: 0.2},
+		{name: "empty strings", a: "", b: "", wantMin: 1, wantMax: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sim := titleSimilarity(tt.a, tt.b)
+			if sim < tt.wantMin || sim > tt.wantMax {
+				t.Errorf("titleSimilarity(%q, %q) = %v, want in [%v, %v]", tt.a, tt.b, sim, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestDCT2DRoundTrip(t *testing.T) {
+	// A flat (constant) image should produce all of its energy in the
+	// DC term (0,0), with every AC coefficient at ~0.
+	const size = 8
+	matrix := make([][]float64, size)
+	for y := range matrix {
+		matrix[y] = make([]float64, size)
+		for x := range matrix[y] {
+			matrix[y][x] = 100
+		}
+	}
+
+	coeffs := dct2D(matrix)
+
+	if math.Abs(coeffs[0][0]) < 1e-6 {
+		t.Fatalf("DC coefficient should carry the flat image's energy, got %v", coeffs[0][0])
+	}
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if y == 0 && x == 0 {
+				continue
+			}
+			if math.Abs(coeffs[y][x]) > 1e-6 {
+				t.Errorf("coeffs[%d][%d] = %v, want ~0 for a flat input", y, x, coeffs[y][x])
+			}
+		}
+	}
+}
+
+func TestDCT2DDistinguishesPatterns(t *testing.T) {
+	flat := make([][]float64, 8)
+	checker := make([][]float64, 8)
+	for y := 0; y < 8; y++ {
+		flat[y] = make([]float64, 8)
+		checker[y] = make([]float64, 8)
+		for x := 0; x < 8; x++ {
+			flat[y][x] = 128
+			if (x+y)%2 == 0 {
+				checker[y][x] = 0
+			} else {
+				checker[y][x] = 255
+			}
+		}
+	}
+
+	flatCoeffs := dct2D(flat)
+	checkerCoeffs := dct2D(checker)
+
+	if flatCoeffs[7][7] == checkerCoeffs[7][7] {
+		t.Errorf("expected distinct high-frequency coefficients for flat vs checkerboard input")
+	}
+}
+
+// TestHashIndexAddConcurrent guards against the write race fixed alongside
+// Render's concurrent fan-out: every concurrent Add must survive the final
+// on-disk index, not just the in-memory one.
+func TestHashIndexAddConcurrent(t *testing.T) {
+	path := t.TempDir() + "/hashindex.db"
+	idx := &HashIndex{path: path}
+	idx.rebuildBuckets()
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := idx.Add(HashEntry{CacheID: i, Title: "story"}); err != nil {
+				t.Errorf("Add: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	reloaded, err := LoadHashIndex(path)
+	if err != nil {
+		t.Fatalf("LoadHashIndex: %v", err)
+	}
+	if len(reloaded.Entries) != n {
+		t.Errorf("on-disk index has %d entries, want %d", len(reloaded.Entries), n)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// ImagePipelineConfig controls how generated images are post-processed for
+// TRMNL's e-ink panel before they're written to disk.
+type ImagePipelineConfig struct {
+	PanelWidth  int
+	PanelHeight int
+	DitherAlgo  string // "floyd-steinberg" or "bayer"
+	Palette     string // "1bit" or "4bit"
+	Format      string // "png"
+	Quality     int    // only used when Format is lossy
+}
+
+const (
+	defaultPanelWidth  = 800
+	defaultPanelHeight = 480
+	defaultDitherAlgo  = "floyd-steinberg"
+	defaultPalette     = "1bit"
+	defaultFormat      = "png"
+)
+
+// ImagePipelineConfigFromEnv builds an ImagePipelineConfig from environment
+// variables, falling back to TRMNL's native panel defaults.
+func ImagePipelineConfigFromEnv() ImagePipelineConfig {
+	cfg := ImagePipelineConfig{
+		PanelWidth:  defaultPanelWidth,
+		PanelHeight: defaultPanelHeight,
+		DitherAlgo:  defaultDitherAlgo,
+		Palette:     defaultPalette,
+		Format:      defaultFormat,
+	}
+
+	if v := os.Getenv("TRMNL_PANEL_WIDTH"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			cfg.PanelWidth = n
+		}
+	}
+	if v := os.Getenv("TRMNL_PANEL_HEIGHT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			cfg.PanelHeight = n
+		}
+	}
+	if v := os.Getenv("TRMNL_DITHER_ALGO"); v != "" {
+		cfg.DitherAlgo = v
+	}
+	if v := os.Getenv("TRMNL_PALETTE"); v != "" {
+		cfg.Palette = v
+	}
+	if v := os.Getenv("TRMNL_IMAGE_FORMAT"); v != "" {
+		cfg.Format = v
+	}
+
+	return cfg
+}
+
+// Filter transforms an image as one stage of the e-ink post-processing
+// pipeline. Name is recorded in PipelineMeta so cache invalidation can
+// detect when the applied filter chain no longer matches the config.
+type Filter interface {
+	Name() string
+	Apply(img image.Image) (image.Image, error)
+}
+
+// ResizeFilter scales the source image to the panel's native dimensions.
+type ResizeFilter struct {
+	Width  int
+	Height int
+}
+
+func (f ResizeFilter) Name() string { return "resize" }
+
+func (f ResizeFilter) Apply(img image.Image) (image.Image, error) {
+	src := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, f.Width, f.Height))
+
+	sx := float64(src.Dx()) / float64(f.Width)
+	sy := float64(src.Dy()) / float64(f.Height)
+
+	for y := 0; y < f.Height; y++ {
+		for x := 0; x < f.Width; x++ {
+			srcX := src.Min.X + int(float64(x)*sx)
+			srcY := src.Min.Y + int(float64(y)*sy)
+			dst.Set(x, y, img.At(srcX, srcY))
+		}
+	}
+
+	return dst, nil
+}
+
+// GrayscaleFilter converts the image to 8-bit grayscale.
+type GrayscaleFilter struct{}
+
+func (f GrayscaleFilter) Name() string { return "grayscale" }
+
+func (f GrayscaleFilter) Apply(img image.Image) (image.Image, error) {
+	bounds := img.Bounds()
+	gray := image.NewGray(bounds)
+	draw.Draw(gray, bounds, img, bounds.Min, draw.Src)
+	return gray, nil
+}
+
+// DitherFilter reduces a grayscale image to the configured palette depth
+// using either Floyd-Steinberg error diffusion or an ordered Bayer matrix.
+type DitherFilter struct {
+	Algo    string
+	Palette string
+}
+
+func (f DitherFilter) Name() string { return fmt.Sprintf("dither:%s:%s", f.Algo, f.Palette) }
+
+func (f DitherFilter) levels() int {
+	if f.Palette == "4bit" {
+		return 16
+	}
+	return 2
+}
+
+func (f DitherFilter) Apply(img image.Image) (image.Image, error) {
+	bounds := img.Bounds()
+	gray := image.NewGray(bounds)
+	draw.Draw(gray, bounds, img, bounds.Min, draw.Src)
+
+	levels := f.levels()
+	step := 255.0 / float64(levels-1)
+
+	switch f.Algo {
+	case "bayer":
+		f.ditherBayer(gray, step)
+	default:
+		f.ditherFloydSteinberg(gray, step)
+	}
+
+	return gray, nil
+}
+
+var bayer4x4 = [4][4]float64{
+	{0, 8, 2, 10},
+	{12, 4, 14, 6},
+	{3, 11, 1, 9},
+	{15, 7, 13, 5},
+}
+
+func (f DitherFilter) ditherBayer(gray *image.Gray, step float64) {
+	bounds := gray.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			threshold := (bayer4x4[y%4][x%4]/16.0 - 0.5) * step
+			old := float64(gray.GrayAt(x, y).Y)
+			quantized := quantize(old+threshold, step)
+			gray.SetGray(x, y, color.Gray{Y: uint8(quantized)})
+		}
+	}
+}
+
+func (f DitherFilter) ditherFloydSteinberg(gray *image.Gray, step float64) {
+	bounds := gray.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	errs := make([][]float64, h)
+	for y := range errs {
+		errs[y] = make([]float64, w)
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			old := float64(gray.GrayAt(bounds.Min.X+x, bounds.Min.Y+y).Y) + errs[y][x]
+			newVal := quantize(old, step)
+			gray.SetGray(bounds.Min.X+x, bounds.Min.Y+y, color.Gray{Y: uint8(newVal)})
+
+			quantErr := old - newVal
+			if x+1 < w {
+				errs[y][x+1] += quantErr * 7 / 16
+			}
+			if y+1 < h {
+				if x-1 >= 0 {
+					errs[y+1][x-1] += quantErr * 3 / 16
+				}
+				errs[y+1][x] += quantErr * 5 / 16
+				if x+1 < w {
+					errs[y+1][x+1] += quantErr * 1 / 16
+				}
+			}
+		}
+	}
+}
+
+func quantize(v, step float64) float64 {
+	if v < 0 {
+		v = 0
+	}
+	if v > 255 {
+		v = 255
+	}
+	return step * float64(int(v/step+0.5))
+}
+
+// EncodeFilter re-encodes the processed image to the target format. Encode
+// buffers are pooled to avoid per-request allocations across renders.
+type EncodeFilter struct {
+	Format  string
+	Quality int
+}
+
+func (f EncodeFilter) Name() string { return fmt.Sprintf("encode:%s", f.Format) }
+
+var encodeBufPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// Encode runs the final encode step and returns the resulting bytes. It is
+// kept separate from Apply because the pipeline's last stage produces bytes
+// rather than an image.Image.
+func (f EncodeFilter) Encode(img image.Image) ([]byte, error) {
+	buf := encodeBufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer encodeBufPool.Put(buf)
+
+	switch f.Format {
+	case "jpeg":
+		quality := f.Quality
+		if quality == 0 {
+			quality = 90
+		}
+		if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, err
+		}
+	default:
+		if err := png.Encode(buf, img); err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([]byte, buf.Len())
+	copy(out, buf.Bytes())
+	return out, nil
+}
+
+// Apply satisfies the Filter interface but is a no-op; encoding happens via
+// Encode once the chain has produced a final image.Image.
+func (f EncodeFilter) Apply(img image.Image) (image.Image, error) { return img, nil }
+
+// PipelineMeta records which filters (and config) were applied to a
+// generated image, written alongside it as a companion .meta.json file so
+// cache invalidation can detect config changes between runs.
+type PipelineMeta struct {
+	Filters []string             `json:"filters"`
+	Config  ImagePipelineConfig `json:"config"`
+}
+
+// ImagePipeline is an ordered chain of Filters applied to a freshly
+// generated image before it's written to the image directory.
+type ImagePipeline struct {
+	filters []Filter
+	encode  EncodeFilter
+	cfg     ImagePipelineConfig
+}
+
+// NewImagePipeline builds the default e-ink pipeline: resize to the panel's
+// native dimensions, grayscale, dither to the configured palette, encode.
+func NewImagePipeline(cfg ImagePipelineConfig) *ImagePipeline {
+	return &ImagePipeline{
+		filters: []Filter{
+			ResizeFilter{Width: cfg.PanelWidth, Height: cfg.PanelHeight},
+			GrayscaleFilter{},
+			DitherFilter{Algo: cfg.DitherAlgo, Palette: cfg.Palette},
+		},
+		encode: EncodeFilter{Format: cfg.Format, Quality: cfg.Quality},
+		cfg:    cfg,
+	}
+}
+
+// Run decodes raw image bytes, applies every filter in order, encodes the
+// result, and returns the encoded bytes plus a PipelineMeta describing what
+// was applied.
+func (p *ImagePipeline) Run(raw []byte) ([]byte, PipelineMeta, error) {
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, PipelineMeta{}, fmt.Errorf("decode source image: %w", err)
+	}
+
+	names := make([]string, 0, len(p.filters)+1)
+	for _, f := range p.filters {
+		img, err = f.Apply(img)
+		if err != nil {
+			return nil, PipelineMeta{}, fmt.Errorf("apply filter %s: %w", f.Name(), err)
+		}
+		names = append(names, f.Name())
+	}
+
+	encoded, err := p.encode.Encode(img)
+	if err != nil {
+		return nil, PipelineMeta{}, fmt.Errorf("encode: %w", err)
+	}
+	names = append(names, p.encode.Name())
+
+	return encoded, PipelineMeta{Filters: names, Config: p.cfg}, nil
+}
+
+// writeMeta writes the companion .meta.json file for a processed image.
+func writeMeta(metaPath string, meta PipelineMeta) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(metaPath, data, 0644)
+}
+
+// metaMatchesConfig reports whether an existing .meta.json file was
+// produced with the given config, so a stale cache entry (e.g. after a
+// panel resolution change) can be regenerated instead of reused.
+func metaMatchesConfig(metaPath string, cfg ImagePipelineConfig) bool {
+	data, err := os.ReadFile(metaPath)
+	if err != nil {
+		return false
+	}
+	var meta PipelineMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return false
+	}
+	return meta.Config == cfg
+}
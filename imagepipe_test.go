@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func solidImage(w, h int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestResizeFilter(t *testing.T) {
+	src := solidImage(8, 4, color.RGBA{R: 200, G: 50, B: 50, A: 255})
+
+	dst, err := ResizeFilter{Width: 800, Height: 480}.Apply(src)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	bounds := dst.Bounds()
+	if bounds.Dx() != 800 || bounds.Dy() != 480 {
+		t.Errorf("resized to %dx%d, want 800x480", bounds.Dx(), bounds.Dy())
+	}
+}
+
+func TestGrayscaleFilter(t *testing.T) {
+	src := solidImage(4, 4, color.RGBA{R: 10, G: 200, B: 30, A: 255})
+
+	out, err := GrayscaleFilter{}.Apply(src)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	if _, ok := out.(*image.Gray); !ok {
+		t.Fatalf("Apply returned %T, want *image.Gray", out)
+	}
+
+	r, g, b, _ := out.At(0, 0).RGBA()
+	if r != g || g != b {
+		t.Errorf("grayscale pixel has mismatched channels: r=%d g=%d b=%d", r, g, b)
+	}
+}
+
+func TestDitherFilter1BitPalette(t *testing.T) {
+	// A left-to-right gradient exercises both light and dark regions.
+	src := image.NewGray(image.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			src.SetGray(x, y, color.Gray{Y: uint8(x * 16)})
+		}
+	}
+
+	for _, algo := range []string{"floyd-steinberg", "bayer"} {
+		t.Run(algo, func(t *testing.T) {
+			out, err := DitherFilter{Algo: algo, Palette: "1bit"}.Apply(src)
+			if err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+			gray, ok := out.(*image.Gray)
+			if !ok {
+				t.Fatalf("Apply returned %T, want *image.Gray", out)
+			}
+
+			bounds := gray.Bounds()
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					v := gray.GrayAt(x, y).Y
+					if v != 0 && v != 255 {
+						t.Fatalf("pixel (%d,%d) = %d, want 0 or 255 for a 1bit palette", x, y, v)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDitherFilter4BitPaletteQuantizesToSixteenLevels(t *testing.T) {
+	src := image.NewGray(image.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			src.SetGray(x, y, color.Gray{Y: uint8(x * 16)})
+		}
+	}
+
+	out, err := DitherFilter{Algo: "bayer", Palette: "4bit"}.Apply(src)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	gray := out.(*image.Gray)
+
+	step := 255.0 / 15.0
+	bounds := gray.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			v := float64(gray.GrayAt(x, y).Y)
+			level := v / step
+			if diff := level - float64(int(level+0.5)); diff < -0.01 || diff > 0.01 {
+				t.Fatalf("pixel (%d,%d) = %v, not a multiple of the 4bit step %v", x, y, v, step)
+			}
+		}
+	}
+}
+
+func TestEncodeFilterPNG(t *testing.T) {
+	src := solidImage(4, 4, color.RGBA{R: 1, G: 2, B: 3, A: 255})
+
+	encoded, err := EncodeFilter{Format: "png"}.Encode(src)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	decoded, err := png.Decode(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("decode encoded PNG: %v", err)
+	}
+	if decoded.Bounds().Dx() != 4 || decoded.Bounds().Dy() != 4 {
+		t.Errorf("decoded %dx%d, want 4x4", decoded.Bounds().Dx(), decoded.Bounds().Dy())
+	}
+}
+
+func TestEncodeFilterJPEGDefaultsQuality(t *testing.T) {
+	src := solidImage(4, 4, color.RGBA{R: 1, G: 2, B: 3, A: 255})
+
+	encoded, err := EncodeFilter{Format: "jpeg"}.Encode(src)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if len(encoded) == 0 {
+		t.Fatal("Encode returned no bytes")
+	}
+}
+
+func TestMetaMatchesConfig(t *testing.T) {
+	dir := t.TempDir()
+	metaPath := filepath.Join(dir, "1.png.meta.json")
+	cfg := ImagePipelineConfig{PanelWidth: 800, PanelHeight: 480, DitherAlgo: "floyd-steinberg", Palette: "1bit", Format: "png"}
+
+	if metaMatchesConfig(metaPath, cfg) {
+		t.Error("metaMatchesConfig matched a file that doesn't exist")
+	}
+
+	if err := writeMeta(metaPath, PipelineMeta{Filters: []string{"resize", "grayscale"}, Config: cfg}); err != nil {
+		t.Fatalf("writeMeta: %v", err)
+	}
+
+	if !metaMatchesConfig(metaPath, cfg) {
+		t.Error("metaMatchesConfig didn't match the config it was just written with")
+	}
+
+	changed := cfg
+	changed.PanelWidth = 600
+	if metaMatchesConfig(metaPath, changed) {
+		t.Error("metaMatchesConfig matched after PanelWidth changed")
+	}
+
+	if err := os.WriteFile(metaPath, []byte("not json"), 0644); err != nil {
+		t.Fatalf("write corrupt meta: %v", err)
+	}
+	if metaMatchesConfig(metaPath, cfg) {
+		t.Error("metaMatchesConfig matched a corrupt meta file")
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ImageStore persists a generated image under the given ID and returns a
+// URL the image can be fetched from. Put is expected to be idempotent for a
+// given ID; Exists lets callers skip re-uploading unchanged images.
+type ImageStore interface {
+	Put(ctx context.Context, id, mime string, r io.Reader) (publicURL string, err error)
+	Exists(ctx context.Context, id string) (publicURL string, ok bool)
+}
+
+// NewImageStoreFromEnv selects an ImageStore backend from IMAGE_STORE
+// ("local", "s3", or "bunny"), defaulting to LocalDirStore.
+func NewImageStoreFromEnv() (ImageStore, error) {
+	switch os.Getenv("IMAGE_STORE") {
+	case "s3":
+		return NewS3StoreFromEnv()
+	case "bunny":
+		return NewBunnyCDNStoreFromEnv(), nil
+	default:
+		return &LocalDirStore{Dir: imageDir}, nil
+	}
+}
+
+// LocalDirStore writes images to a local directory and returns their
+// filesystem path, matching the original pre-ImageStore behavior.
+type LocalDirStore struct {
+	Dir string
+}
+
+func (s *LocalDirStore) Put(ctx context.Context, id, mime string, r io.Reader) (string, error) {
+	path := filepath.Join(s.Dir, id)
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func (s *LocalDirStore) Exists(ctx context.Context, id string) (string, bool) {
+	path := filepath.Join(s.Dir, id)
+	if _, err := os.Stat(path); err != nil {
+		return "", false
+	}
+	return path, true
+}
+
+// S3Store uploads images to an S3 bucket and returns their virtual-hosted
+// style URL.
+type S3Store struct {
+	client *s3.Client
+	Bucket string
+	Region string
+	Prefix string
+	ACL    string
+}
+
+// NewS3StoreFromEnv builds an S3Store from S3_BUCKET, S3_REGION, S3_PREFIX,
+// and S3_ACL environment variables, loading credentials the standard AWS
+// SDK way (env vars, shared config, instance profile, etc).
+func NewS3StoreFromEnv() (*S3Store, error) {
+	region := os.Getenv("S3_REGION")
+	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("load AWS config: %w", err)
+	}
+
+	return &S3Store{
+		client: s3.NewFromConfig(cfg),
+		Bucket: os.Getenv("S3_BUCKET"),
+		Region: region,
+		Prefix: os.Getenv("S3_PREFIX"),
+		ACL:    os.Getenv("S3_ACL"),
+	}, nil
+}
+
+func (s *S3Store) key(id string) string {
+	if s.Prefix == "" {
+		return id
+	}
+	return fmt.Sprintf("%s/%s", s.Prefix, id)
+}
+
+func (s *S3Store) url(id string) string {
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.Bucket, s.Region, s.key(id))
+}
+
+func (s *S3Store) Put(ctx context.Context, id, mime string, r io.Reader) (string, error) {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.Bucket),
+		Key:         aws.String(s.key(id)),
+		Body:        r,
+		ContentType: aws.String(mime),
+	}
+	if s.ACL != "" {
+		input.ACL = s3types.ObjectCannedACL(s.ACL)
+	}
+
+	if _, err := s.client.PutObject(ctx, input); err != nil {
+		return "", fmt.Errorf("put object %s: %w", id, err)
+	}
+
+	return s.url(id), nil
+}
+
+func (s *S3Store) Exists(ctx context.Context, id string) (string, bool) {
+	_, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.key(id)),
+	})
+	if err != nil {
+		return "", false
+	}
+	return s.url(id), true
+}
+
+// BunnyCDNStore uploads images to BunnyCDN storage and serves them back
+// through the configured pull zone.
+type BunnyCDNStore struct {
+	Zone         string
+	AccessKey    string
+	PullZoneHost string
+	httpClient   *http.Client
+}
+
+// NewBunnyCDNStoreFromEnv builds a BunnyCDNStore from BUNNY_ZONE,
+// BUNNY_ACCESS_KEY, and BUNNY_PULL_ZONE_HOST environment variables.
+func NewBunnyCDNStoreFromEnv() *BunnyCDNStore {
+	return &BunnyCDNStore{
+		Zone:         os.Getenv("BUNNY_ZONE"),
+		AccessKey:    os.Getenv("BUNNY_ACCESS_KEY"),
+		PullZoneHost: os.Getenv("BUNNY_PULL_ZONE_HOST"),
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *BunnyCDNStore) storageURL(id string) string {
+	return fmt.Sprintf("https://storage.bunnycdn.com/%s/%s", s.Zone, id)
+}
+
+func (s *BunnyCDNStore) publicURL(id string) string {
+	return fmt.Sprintf("https://%s/%s", s.PullZoneHost, id)
+}
+
+func (s *BunnyCDNStore) Put(ctx context.Context, id, mime string, r io.Reader) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.storageURL(id), r)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("AccessKey", s.AccessKey)
+	req.Header.Set("Content-Type", mime)
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("bunnycdn put %s: %w", id, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("bunnycdn put %s: status %d: %s", id, resp.StatusCode, string(body))
+	}
+
+	return s.publicURL(id), nil
+}
+
+func (s *BunnyCDNStore) Exists(ctx context.Context, id string) (string, bool) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.publicURL(id), nil)
+	if err != nil {
+		return "", false
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", false
+	}
+	return s.publicURL(id), true
+}
+
+// uploadState de-duplicates concurrent uploads of the same cache ID: the
+// first caller performs the Put, later callers for the same ID wait on the
+// same sync.Once and receive the same result.
+type uploadState struct {
+	once sync.Once
+	url  string
+	err  error
+}
+
+func mimeForFormat(format string) string {
+	switch format {
+	case "jpeg", "jpg":
+		return "image/jpeg"
+	default:
+		return "image/png"
+	}
+}
+
+// uploadImage uploads processed image bytes for cacheID at most once,
+// regardless of how many goroutines call it concurrently for the same ID.
+func (h *HackerNewsFeed) uploadImage(ctx context.Context, cacheID int, id string, data []byte) (string, error) {
+	v, _ := h.uploads.LoadOrStore(cacheID, &uploadState{})
+	state := v.(*uploadState)
+
+	state.once.Do(func() {
+		if url, ok := h.imageStore.Exists(ctx, id); ok {
+			state.url = url
+			return
+		}
+		state.url, state.err = h.imageStore.Put(ctx, id, mimeForFormat(h.imagePipeline.cfg.Format), bytes.NewReader(data))
+	})
+
+	return state.url, state.err
+}
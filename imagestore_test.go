@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestLocalDirStorePutAndExists(t *testing.T) {
+	dir := t.TempDir()
+	store := &LocalDirStore{Dir: dir}
+	ctx := context.Background()
+
+	if _, ok := store.Exists(ctx, "1.png"); ok {
+		t.Error("Exists reported true before Put")
+	}
+
+	url, err := store.Put(ctx, "1.png", "image/png", bytes.NewReader([]byte("pixels")))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if url != filepath.Join(dir, "1.png") {
+		t.Errorf("Put returned %q, want %q", url, filepath.Join(dir, "1.png"))
+	}
+
+	got, err := os.ReadFile(url)
+	if err != nil {
+		t.Fatalf("read written file: %v", err)
+	}
+	if string(got) != "pixels" {
+		t.Errorf("written content = %q, want %q", got, "pixels")
+	}
+
+	existsURL, ok := store.Exists(ctx, "1.png")
+	if !ok || existsURL != url {
+		t.Errorf("Exists = (%q, %v), want (%q, true)", existsURL, ok, url)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestBunnyCDNStorePutSignsAndUploads(t *testing.T) {
+	var gotMethod, gotURL, gotAccessKey, gotContentType string
+	store := &BunnyCDNStore{
+		Zone:         "my-zone",
+		AccessKey:    "secret-key",
+		PullZoneHost: "cdn.example.com",
+		httpClient: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			gotMethod = req.Method
+			gotURL = req.URL.String()
+			gotAccessKey = req.Header.Get("AccessKey")
+			gotContentType = req.Header.Get("Content-Type")
+			return &http.Response{StatusCode: http.StatusCreated, Body: io.NopCloser(bytes.NewReader(nil))}, nil
+		})},
+	}
+
+	url, err := store.Put(context.Background(), "42.png", "image/png", bytes.NewReader([]byte("data")))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if gotMethod != http.MethodPut {
+		t.Errorf("method = %q, want PUT", gotMethod)
+	}
+	if gotURL != "https://storage.bunnycdn.com/my-zone/42.png" {
+		t.Errorf("upload URL = %q", gotURL)
+	}
+	if gotAccessKey != "secret-key" {
+		t.Errorf("AccessKey header = %q, want %q", gotAccessKey, "secret-key")
+	}
+	if gotContentType != "image/png" {
+		t.Errorf("Content-Type header = %q, want image/png", gotContentType)
+	}
+	if url != "https://cdn.example.com/42.png" {
+		t.Errorf("Put returned %q, want pull-zone URL", url)
+	}
+}
+
+func TestBunnyCDNStorePutReturnsErrorOnFailure(t *testing.T) {
+	store := &BunnyCDNStore{
+		Zone:      "my-zone",
+		AccessKey: "secret-key",
+		httpClient: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusForbidden, Body: io.NopCloser(bytes.NewReader([]byte("denied")))}, nil
+		})},
+	}
+
+	if _, err := store.Put(context.Background(), "42.png", "image/png", bytes.NewReader([]byte("data"))); err == nil {
+		t.Fatal("Put returned nil error for a 403 response")
+	}
+}
+
+func TestBunnyCDNStoreExists(t *testing.T) {
+	store := &BunnyCDNStore{
+		PullZoneHost: "cdn.example.com",
+		httpClient: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			if req.Method != http.MethodHead {
+				t.Errorf("method = %q, want HEAD", req.Method)
+			}
+			if req.URL.String() == "https://cdn.example.com/missing.png" {
+				return &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(bytes.NewReader(nil))}, nil
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(nil))}, nil
+		})},
+	}
+
+	if url, ok := store.Exists(context.Background(), "1.png"); !ok || url != "https://cdn.example.com/1.png" {
+		t.Errorf("Exists(1.png) = (%q, %v), want (present, true)", url, ok)
+	}
+	if _, ok := store.Exists(context.Background(), "missing.png"); ok {
+		t.Error("Exists(missing.png) = true, want false")
+	}
+}
+
+func TestS3StorePutAndExists(t *testing.T) {
+	var gotPaths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPaths = append(gotPaths, r.Method+" "+r.URL.Path)
+		switch r.Method {
+		case http.MethodPut:
+			w.WriteHeader(http.StatusOK)
+		case http.MethodHead:
+			if strings.Contains(r.URL.Path, "missing.png") {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer server.Close()
+
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+	})
+
+	store := &S3Store{client: client, Bucket: "bucket", Region: "us-east-1", Prefix: "prefix"}
+
+	if key := store.key("1.png"); key != "prefix/1.png" {
+		t.Errorf("key = %q, want prefix/1.png", key)
+	}
+	if url := store.url("1.png"); url != "https://bucket.s3.us-east-1.amazonaws.com/prefix/1.png" {
+		t.Errorf("url = %q", url)
+	}
+
+	url, err := store.Put(context.Background(), "1.png", "image/png", bytes.NewReader([]byte("data")))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if url != store.url("1.png") {
+		t.Errorf("Put returned %q, want %q", url, store.url("1.png"))
+	}
+
+	if _, ok := store.Exists(context.Background(), "1.png"); !ok {
+		t.Error("Exists(1.png) = false, want true")
+	}
+	if _, ok := store.Exists(context.Background(), "missing.png"); ok {
+		t.Error("Exists(missing.png) = true, want false")
+	}
+
+	if len(gotPaths) == 0 {
+		t.Fatal("no requests reached the test server")
+	}
+}
+
+// countingStore wraps an ImageStore and counts Put calls, so tests can
+// assert that concurrent callers collapse into a single upload.
+type countingStore struct {
+	mu    sync.Mutex
+	puts  int
+	inner ImageStore
+}
+
+func (s *countingStore) Put(ctx context.Context, id, mime string, r io.Reader) (string, error) {
+	s.mu.Lock()
+	s.puts++
+	s.mu.Unlock()
+	return s.inner.Put(ctx, id, mime, r)
+}
+
+func (s *countingStore) Exists(ctx context.Context, id string) (string, bool) {
+	return s.inner.Exists(ctx, id)
+}
+
+func TestUploadImageSingleFlight(t *testing.T) {
+	store := &countingStore{inner: &LocalDirStore{Dir: t.TempDir()}}
+	feed := &HackerNewsFeed{
+		imageStore:    store,
+		imagePipeline: NewImagePipeline(ImagePipelineConfig{Format: "png"}),
+	}
+
+	const n = 20
+	var wg sync.WaitGroup
+	urls := make([]string, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			urls[i], errs[i] = feed.uploadImage(context.Background(), 7, "7.png", []byte("data"))
+		}()
+	}
+	wg.Wait()
+
+	if store.puts != 1 {
+		t.Errorf("Put called %d times, want 1 for concurrent uploads of the same cacheID", store.puts)
+	}
+	for i := range urls {
+		if errs[i] != nil {
+			t.Fatalf("uploadImage[%d]: %v", i, errs[i])
+		}
+		if urls[i] != urls[0] {
+			t.Errorf("urls[%d] = %q, want %q (every caller should see the same result)", i, urls[i], urls[0])
+		}
+	}
+}
@@ -2,15 +2,23 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
+
+	"golang.org/x/sync/errgroup"
 )
 
 const (
@@ -51,12 +59,10 @@ type Metadata struct {
 	TotalCount  int    `json:"totalCount"`
 	LastUpdated string `json:"lastUpdated"`
 	Version     string `json:"version"`
+	Chunk       int    `json:"chunk,omitempty"`
+	TotalChunks int    `json:"totalChunks,omitempty"`
 }
 
-// type WebhookData struct {
-// 	MergeVariables Response `json:"merge_variables"`
-// }
-
 type GeminiRequest struct {
 	Contents         []GeminiContent  `json:"contents"`
 	GenerationConfig GenerationConfig `json:"generationConfig"`
@@ -98,15 +104,60 @@ type HackerNewsFeed struct {
 	forceUpdate          bool
 	testMode             bool
 	bestStoriesCacheFile string
+	maxConcurrency       int
+	imagePipeline        *ImagePipeline
+	imageStore           ImageStore
+	hashIndex            *HashIndex
+	dedupCfg             DedupConfig
+	uploads              sync.Map // cacheID -> *uploadState
+	generations          sync.Map // cacheID -> *genState
+	defaultImageMu       sync.Mutex
+	defaultImageURLCache string
+}
+
+// genState single-flights a generateImageOnce call for a cacheID.
+type genState struct {
+	once   sync.Once
+	result string
 }
 
+const defaultMaxConcurrency = 4
+
 func NewHackerNewsFeed() *HackerNewsFeed {
+	imagePipelineCfg := ImagePipelineConfigFromEnv()
+
+	imageStore, err := NewImageStoreFromEnv()
+	if err != nil {
+		log.Printf("Error configuring image store, falling back to local: %v", err)
+		imageStore = &LocalDirStore{Dir: imageDir}
+	}
+
+	maxConcurrency := defaultMaxConcurrency
+	if v := os.Getenv("MAX_CONCURRENCY"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			maxConcurrency = n
+		}
+	}
+
+	hashIndexPath := filepath.Join(cacheDir, "hashindex.db")
+	hashIndex, err := LoadHashIndex(hashIndexPath)
+	if err != nil {
+		log.Printf("Error loading hash index, starting empty: %v", err)
+		hashIndex = &HashIndex{path: hashIndexPath}
+		hashIndex.rebuildBuckets()
+	}
+
 	feed := &HackerNewsFeed{
 		geminiAPIKey:         os.Getenv("GEMINI_API_KEY"),
 		webhookURL:           os.Getenv("TRMNL_WEBHOOK_URL"),
 		forceUpdate:          os.Getenv("FORCE_UPDATE") == "true",
 		testMode:             os.Getenv("TEST_MODE") == "true",
 		bestStoriesCacheFile: filepath.Join(cacheDir, "beststories.json"),
+		maxConcurrency:       maxConcurrency,
+		imagePipeline:        NewImagePipeline(imagePipelineCfg),
+		imageStore:           imageStore,
+		hashIndex:            hashIndex,
+		dedupCfg:             DedupConfigFromEnv(),
 	}
 
 	feed.ensureDirectories()
@@ -122,14 +173,19 @@ func (h *HackerNewsFeed) ensureDirectories() {
 	}
 }
 
-func (h *HackerNewsFeed) getFeed(url, cacheFile string) ([]byte, error) {
+func (h *HackerNewsFeed) getFeed(ctx context.Context, url, cacheFile string) ([]byte, error) {
 	if !h.forceUpdate {
 		if data, err := os.ReadFile(cacheFile); err == nil {
 			return data, nil
 		}
 	}
 
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		// Try to fall back to cache
 		if data, cacheErr := os.ReadFile(cacheFile); cacheErr == nil {
@@ -151,11 +207,11 @@ func (h *HackerNewsFeed) getFeed(url, cacheFile string) ([]byte, error) {
 	return data, nil
 }
 
-func (h *HackerNewsFeed) getStory(id int) (*Story, error) {
+func (h *HackerNewsFeed) getStory(ctx context.Context, id int) (*Story, error) {
 	cacheFile := filepath.Join(cacheDir, fmt.Sprintf("%d.json", id))
 	url := fmt.Sprintf("%s%d.json", storyBaseURL, id)
 
-	data, err := h.getFeed(url, cacheFile)
+	data, err := h.getFeed(ctx, url, cacheFile)
 	if err != nil {
 		return nil, err
 	}
@@ -169,9 +225,18 @@ func (h *HackerNewsFeed) getStory(id int) (*Story, error) {
 }
 
 func (h *HackerNewsFeed) cleanOldImages() {
-	files, err := filepath.Glob(filepath.Join(imageDir, "*.jpg"))
-	if err != nil {
-		return
+	globs := []string{
+		filepath.Join(imageDir, "*.jpg"),
+		filepath.Join(imageDir, "*.png"),
+		filepath.Join(cacheDir, "*.meta.json"),
+	}
+	var files []string
+	for _, pattern := range globs {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return
+		}
+		files = append(files, matches...)
 	}
 
 	thirtyDaysAgo := time.Now().Add(-30 * 24 * time.Hour)
@@ -186,61 +251,107 @@ func (h *HackerNewsFeed) cleanOldImages() {
 	}
 }
 
-func (h *HackerNewsFeed) generateImage(prompt string, cacheID int) string {
+// generateImage single-flights calls for the same cacheID: if Render is
+// invoked concurrently (overlapping runs, or later from an HTTP handler)
+// only one Gemini request is in flight per story and every caller waits on
+// the same result.
+func (h *HackerNewsFeed) generateImage(ctx context.Context, title, prompt string, cacheID int) string {
+	v, _ := h.generations.LoadOrStore(cacheID, &genState{})
+	state := v.(*genState)
+	state.once.Do(func() {
+		state.result = h.generateImageOnce(ctx, title, prompt, cacheID)
+	})
+	return state.result
+}
+
+// buildTestJPEG returns a tiny valid 1x1 JPEG so TEST_MODE can exercise the
+// real post-processing/hash/upload pipeline without calling Gemini.
+func buildTestJPEG() ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	img.Set(0, 0, color.RGBA{R: 200, G: 30, B: 30, A: 255})
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// defaultImageURL returns a fetchable public URL for the fallback image used
+// when Gemini is unavailable or generation fails. A bare local filename is
+// useless once StoryImage is POSTed to a remote TRMNL webhook, so it's
+// uploaded through the configured ImageStore (or reused if already there)
+// the first time it's needed. The upload result is cached, but a failure is
+// not: a transient store outage should be retried on the next fallback
+// rather than wedging every later story onto the bare filename for the rest
+// of the process's life. Falls back to the bare filename only if the store
+// has neither a copy nor a local asset to upload from on a given attempt.
+func (h *HackerNewsFeed) defaultImageURL(ctx context.Context) string {
+	h.defaultImageMu.Lock()
+	defer h.defaultImageMu.Unlock()
+
+	if h.defaultImageURLCache != "" {
+		return h.defaultImageURLCache
+	}
+
+	if url, ok := h.imageStore.Exists(ctx, defaultImage); ok {
+		h.defaultImageURLCache = url
+		return url
+	}
+
+	data, err := os.ReadFile(filepath.Join(imageDir, defaultImage))
+	if err != nil {
+		log.Printf("Error reading local default image, falling back to %q: %v", defaultImage, err)
+		return defaultImage
+	}
+
+	url, err := h.imageStore.Put(ctx, defaultImage, mimeForFormat("png"), bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Error uploading default image, falling back to %q: %v", defaultImage, err)
+		return defaultImage
+	}
+	h.defaultImageURLCache = url
+	return url
+}
+
+func (h *HackerNewsFeed) generateImageOnce(ctx context.Context, title, prompt string, cacheID int) string {
 	h.cleanOldImages()
 
-	imagePath := filepath.Join(imageDir, fmt.Sprintf("%d.jpg", cacheID))
+	imageID := fmt.Sprintf("%d.%s", cacheID, h.imagePipeline.cfg.Format)
+	metaPath := filepath.Join(cacheDir, imageID+".meta.json")
+
+	// Check if a processed image already exists in the store for the current pipeline config
+	if metaMatchesConfig(metaPath, h.imagePipeline.cfg) {
+		if url, ok := h.imageStore.Exists(ctx, imageID); ok {
+			return url
+		}
+	}
 
-	// Check if image already exists
-	if _, err := os.Stat(imagePath); err == nil {
-		return imagePath
+	// Reuse an existing image if a near-duplicate story (e.g. a "Show HN" repost
+	// or follow-up) already has one, skipping Gemini entirely.
+	if reused, ok := h.reuseByTitle(ctx, title); ok {
+		return reused
 	}
 
-	// Test mode: generate a small test image without calling API
+	// Test mode: generate a small test image without calling the API
 	if h.testMode {
-		log.Printf("TEST_MODE: Creating test image at %s", imagePath)
-		// 1x1 red pixel JPEG
-		testJPEG := []byte{
-			0xff, 0xd8, 0xff, 0xe0, 0x00, 0x10, 0x4a, 0x46, 0x49, 0x46, 0x00, 0x01,
-			0x01, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0xff, 0xdb, 0x00, 0x43,
-			0x00, 0x08, 0x06, 0x06, 0x07, 0x06, 0x05, 0x08, 0x07, 0x07, 0x07, 0x09,
-			0x09, 0x08, 0x0a, 0x0c, 0x14, 0x0d, 0x0c, 0x0b, 0x0b, 0x0c, 0x19, 0x12,
-			0x13, 0x0f, 0x14, 0x1d, 0x1a, 0x1f, 0x1e, 0x1d, 0x1a, 0x1c, 0x1c, 0x20,
-			0x24, 0x2e, 0x27, 0x20, 0x22, 0x2c, 0x23, 0x1c, 0x1c, 0x28, 0x37, 0x29,
-			0x2c, 0x30, 0x31, 0x34, 0x34, 0x34, 0x1f, 0x27, 0x39, 0x3d, 0x38, 0x32,
-			0x3c, 0x2e, 0x33, 0x34, 0x32, 0xff, 0xc0, 0x00, 0x0b, 0x08, 0x00, 0x01,
-			0x00, 0x01, 0x01, 0x01, 0x11, 0x00, 0xff, 0xc4, 0x00, 0x1f, 0x00, 0x00,
-			0x01, 0x05, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00,
-			0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
-			0x09, 0x0a, 0x0b, 0xff, 0xc4, 0x00, 0xb5, 0x10, 0x00, 0x02, 0x01, 0x03,
-			0x03, 0x02, 0x04, 0x03, 0x05, 0x05, 0x04, 0x04, 0x00, 0x00, 0x01, 0x7d,
-			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12, 0x21, 0x31, 0x41, 0x06,
-			0x13, 0x51, 0x61, 0x07, 0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
-			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0, 0x24, 0x33, 0x62, 0x72,
-			0x82, 0x09, 0x0a, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
-			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45,
-			0x46, 0x47, 0x48, 0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
-			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69, 0x6a, 0x73, 0x74, 0x75,
-			0x76, 0x77, 0x78, 0x79, 0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
-			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3,
-			0xa4, 0xa5, 0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
-			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9,
-			0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
-			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf1, 0xf2, 0xf3, 0xf4,
-			0xf5, 0xf6, 0xf7, 0xf8, 0xf9, 0xfa, 0xff, 0xda, 0x00, 0x08, 0x01, 0x01,
-			0x00, 0x00, 0x3f, 0x00, 0xfb, 0xd5, 0xdb, 0x20, 0xa8, 0xf1, 0x7e, 0xe9,
-			0xf3, 0x61, 0xa0, 0x7f, 0xff, 0xd9,
+		log.Printf("TEST_MODE: Creating test image %s", imageID)
+		testJPEG, err := buildTestJPEG()
+		if err != nil {
+			log.Printf("TEST_MODE: Error building test image: %v", err)
+			return h.defaultImageURL(ctx)
 		}
-		if err := os.WriteFile(imagePath, testJPEG, 0644); err != nil {
+		publicURL, err := h.finishGeneration(ctx, testJPEG, title, cacheID, imageID, metaPath)
+		if err != nil {
 			log.Printf("TEST_MODE: Error writing test image: %v", err)
-			return defaultImage
+			return h.defaultImageURL(ctx)
 		}
-		return imagePath
+		return publicURL
 	}
 
 	if h.geminiAPIKey == "" {
 		log.Println("GEMINI_API_KEY not set, using default image")
-		return defaultImage
+		return h.defaultImageURL(ctx)
 	}
 
 	url := fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/%s:generateContent?key=%s", geminiModel, h.geminiAPIKey)
@@ -261,13 +372,13 @@ func (h *HackerNewsFeed) generateImage(prompt string, cacheID int) string {
 	jsonData, err := json.Marshal(reqBody)
 	if err != nil {
 		log.Printf("Error marshaling request: %v", err)
-		return defaultImage
+		return h.defaultImageURL(ctx)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		log.Printf("Error creating request: %v", err)
-		return defaultImage
+		return h.defaultImageURL(ctx)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
@@ -276,20 +387,20 @@ func (h *HackerNewsFeed) generateImage(prompt string, cacheID int) string {
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Printf("Error making request: %v", err)
-		return defaultImage
+		return h.defaultImageURL(ctx)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		log.Printf("Error reading response: %v", err)
-		return defaultImage
+		return h.defaultImageURL(ctx)
 	}
 
 	var geminiResp GeminiResponse
 	if err := json.Unmarshal(body, &geminiResp); err != nil {
 		log.Printf("Error unmarshaling response: %v", err)
-		return defaultImage
+		return h.defaultImageURL(ctx)
 	}
 
 	// Extract base64 image data
@@ -300,24 +411,85 @@ func (h *HackerNewsFeed) generateImage(prompt string, cacheID int) string {
 				decoded, err := base64.StdEncoding.DecodeString(imageData)
 				if err != nil {
 					log.Printf("Error decoding base64: %v", err)
-					return defaultImage
+					return h.defaultImageURL(ctx)
 				}
 
-				if err := os.WriteFile(imagePath, decoded, 0644); err != nil {
-					log.Printf("Error writing image: %v", err)
-					return defaultImage
+				publicURL, err := h.finishGeneration(ctx, decoded, title, cacheID, imageID, metaPath)
+				if err != nil {
+					log.Printf("Error processing image: %v", err)
+					return h.defaultImageURL(ctx)
 				}
 
-				return imagePath
+				return publicURL
 			}
 		}
 	}
 
 	log.Printf("No image data in response. Raw response: %s", string(body))
-	return defaultImage
+	return h.defaultImageURL(ctx)
+}
+
+// reuseByTitle looks up the hash index for a previously generated image
+// whose story title is similar enough to title (e.g. a "Show HN" repost or
+// reworded follow-up) and, if its image is still in the store, returns its
+// public URL so Gemini doesn't need to be called again.
+func (h *HackerNewsFeed) reuseByTitle(ctx context.Context, title string) (string, bool) {
+	entry, ok := h.hashIndex.FindByTitle(title, h.dedupCfg.TitleSim)
+	if !ok {
+		return "", false
+	}
+
+	reuseImageID := fmt.Sprintf("%d.%s", entry.CacheID, h.imagePipeline.cfg.Format)
+	url, ok := h.imageStore.Exists(ctx, reuseImageID)
+	if !ok {
+		return "", false
+	}
+
+	log.Printf("Reusing image from cacheID %d for similar title %q", entry.CacheID, title)
+	return url, true
+}
+
+// finishGeneration hashes a freshly generated image and, if it's a
+// near-duplicate of one already in the index (within the configured
+// Hamming distance), reuses that image instead. Otherwise it runs the
+// e-ink pipeline, uploads the result, writes the companion .meta.json file,
+// and records the new image's hashes for future dedup lookups.
+func (h *HackerNewsFeed) finishGeneration(ctx context.Context, raw []byte, title string, cacheID int, imageID, metaPath string) (string, error) {
+	hashes, err := computeHashesFromBytes(raw)
+	if err != nil {
+		return "", fmt.Errorf("compute image hashes: %w", err)
+	}
+
+	if entry, ok := h.hashIndex.FindByPHash(hashes.PHash, h.dedupCfg.PHashDist); ok {
+		reuseImageID := fmt.Sprintf("%d.%s", entry.CacheID, h.imagePipeline.cfg.Format)
+		if url, ok := h.imageStore.Exists(ctx, reuseImageID); ok {
+			log.Printf("Reusing near-duplicate image from cacheID %d for cacheID %d", entry.CacheID, cacheID)
+			return url, nil
+		}
+	}
+
+	processed, meta, err := h.imagePipeline.Run(raw)
+	if err != nil {
+		return "", err
+	}
+
+	publicURL, err := h.uploadImage(ctx, cacheID, imageID, processed)
+	if err != nil {
+		return "", err
+	}
+
+	if err := writeMeta(metaPath, meta); err != nil {
+		return "", err
+	}
+
+	if err := h.hashIndex.Add(HashEntry{CacheID: cacheID, Title: title, AHash: hashes.AHash, DHash: hashes.DHash, PHash: hashes.PHash}); err != nil {
+		log.Printf("Error updating hash index: %v", err)
+	}
+
+	return publicURL, nil
 }
 
-func (h *HackerNewsFeed) formatStory(id int, story *Story) FormattedStory {
+func (h *HackerNewsFeed) formatStory(ctx context.Context, id int, story *Story) FormattedStory {
 	timestamp := time.Unix(story.Time, 0).Format("Jan 2, 2006")
 
 	storyURL := story.URL
@@ -326,12 +498,12 @@ func (h *HackerNewsFeed) formatStory(id int, story *Story) FormattedStory {
 	}
 
 	imagePrompt := fmt.Sprintf(imagePromptTemplate, story.Title)
-	imagePath := h.generateImage(imagePrompt, id)
+	storyImage := h.generateImage(ctx, story.Title, imagePrompt, id)
 
 	return FormattedStory{
 		StoryTitle:     story.Title,
 		StoryURL:       storyURL,
-		StoryImage:     imagePath,
+		StoryImage:     storyImage,
 		StoryTimestamp: timestamp,
 		StoryID:        id,
 		StoryScore:     story.Score,
@@ -339,7 +511,9 @@ func (h *HackerNewsFeed) formatStory(id int, story *Story) FormattedStory {
 }
 
 func (h *HackerNewsFeed) Render() []FormattedStory {
-	data, err := h.getFeed(bestStoriesURL, h.bestStoriesCacheFile)
+	ctx := context.Background()
+
+	data, err := h.getFeed(ctx, bestStoriesURL, h.bestStoriesCacheFile)
 	if err != nil {
 		log.Printf("Failed to fetch best stories: %v", err)
 		return []FormattedStory{}
@@ -356,51 +530,40 @@ func (h *HackerNewsFeed) Render() []FormattedStory {
 		storyIDs = storyIDs[:storiesToFetch]
 	}
 
-	var stories []FormattedStory
-	for _, id := range storyIDs {
-		story, err := h.getStory(id)
-		if err != nil {
-			log.Printf("Failed to fetch story %d: %v", id, err)
-			continue
+	// Fan out story fetch + image generation across a worker pool, capped at
+	// maxConcurrency, while preserving the input ordering in the result.
+	slots := make([]*FormattedStory, len(storyIDs))
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(h.maxConcurrency)
+
+	for i, id := range storyIDs {
+		i, id := i, id
+		g.Go(func() error {
+			story, err := h.getStory(gctx, id)
+			if err != nil {
+				log.Printf("Failed to fetch story %d: %v", id, err)
+				return nil
+			}
+			formatted := h.formatStory(gctx, id, story)
+			slots[i] = &formatted
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		log.Printf("Error rendering stories: %v", err)
+	}
+
+	stories := make([]FormattedStory, 0, len(slots))
+	for _, s := range slots {
+		if s != nil {
+			stories = append(stories, *s)
 		}
-		stories = append(stories, h.formatStory(id, story))
 	}
 
 	return stories
 }
 
-// Commented out: TRMNL webhook publishing
-// func (h *HackerNewsFeed) publishToTRMNL(data WebhookData) error {
-// 	if h.webhookURL == "" {
-// 		return fmt.Errorf("TRMNL_WEBHOOK_URL not set")
-// 	}
-//
-// 	jsonData, err := json.Marshal(data)
-// 	if err != nil {
-// 		return err
-// 	}
-//
-// 	req, err := http.NewRequest("POST", h.webhookURL, bytes.NewBuffer(jsonData))
-// 	if err != nil {
-// 		return err
-// 	}
-//
-// 	req.Header.Set("Content-Type", "application/json")
-//
-// 	client := &http.Client{Timeout: 30 * time.Second}
-// 	resp, err := client.Do(req)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	defer resp.Body.Close()
-//
-// 	body, _ := io.ReadAll(resp.Body)
-// 	log.Printf("Webhook Response Code: %d", resp.StatusCode)
-// 	log.Printf("Webhook Response: %s", string(body))
-//
-// 	return nil
-// }
-
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
@@ -424,12 +587,20 @@ func main() {
 
 	fmt.Println(string(output))
 
-	// Commented out: TRMNL webhook publishing
-	// webhookData := WebhookData{
-	// 	MergeVariables: response,
-	// }
-	//
-	// if err := feed.publishToTRMNL(webhookData); err != nil {
-	// 	log.Printf("Failed to publish to TRMNL: %v", err)
-	// }
+	if os.Getenv("DRY_RUN") == "true" {
+		publisher := NewPublisher(feed.webhookURL, os.Getenv("TRMNL_WEBHOOK_SECRET"))
+		diff, err := publisher.DryRun(response)
+		if err != nil {
+			log.Fatalf("Failed to compute dry-run diff: %v", err)
+		}
+		fmt.Println(diff)
+		return
+	}
+
+	if os.Getenv("PUBLISH") == "true" {
+		publisher := NewPublisher(feed.webhookURL, os.Getenv("TRMNL_WEBHOOK_SECRET"))
+		if err := publisher.Publish(context.Background(), response); err != nil {
+			log.Printf("Failed to publish to TRMNL: %v", err)
+		}
+	}
 }
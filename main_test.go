@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// chdirTemp changes the working directory to a fresh t.TempDir() for the
+// duration of the test, so NewHackerNewsFeed's cacheDir/imageDir creation
+// can't clobber the real cache/image data at the repo root.
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	origWD, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("Chdir: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(origWD) })
+}
+
+// TestNewHackerNewsFeedMaxConcurrency covers the MAX_CONCURRENCY env parsing
+// that Render's errgroup fan-out relies on to cap its worker pool.
+func TestNewHackerNewsFeedMaxConcurrency(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		want int
+	}{
+		{name: "unset falls back to default", env: "", want: defaultMaxConcurrency},
+		{name: "valid override", env: "8", want: 8},
+		{name: "zero is ignored", env: "0", want: defaultMaxConcurrency},
+		{name: "negative is ignored", env: "-1", want: defaultMaxConcurrency},
+		{name: "non-numeric is ignored", env: "nope", want: defaultMaxConcurrency},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env == "" {
+				os.Unsetenv("MAX_CONCURRENCY")
+			} else {
+				t.Setenv("MAX_CONCURRENCY", tt.env)
+			}
+			chdirTemp(t)
+
+			feed := NewHackerNewsFeed()
+			if feed.maxConcurrency != tt.want {
+				t.Errorf("maxConcurrency = %d, want %d", feed.maxConcurrency, tt.want)
+			}
+		})
+	}
+}
+
+// TestGenerateImageSingleFlight covers the other half of the request:
+// concurrent generateImage calls for the same cacheID (as Render's fanned-out
+// workers would produce if a story ever appeared twice) must collapse into a
+// single image generation, with every caller seeing that one result.
+func TestGenerateImageSingleFlight(t *testing.T) {
+	t.Setenv("TEST_MODE", "true")
+	chdirTemp(t)
+
+	feed := NewHackerNewsFeed()
+	store := &countingStore{inner: feed.imageStore}
+	feed.imageStore = store
+
+	const n = 20
+	var wg sync.WaitGroup
+	results := make([]string, n)
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = feed.generateImage(context.Background(), "Same story", "prompt", 42)
+		}()
+	}
+	wg.Wait()
+
+	if store.puts != 1 {
+		t.Errorf("image store Put called %d times, want 1 for %d concurrent generateImage calls sharing a cacheID", store.puts, n)
+	}
+	for i, r := range results {
+		if r != results[0] {
+			t.Errorf("results[%d] = %q, want %q (every caller should see the single-flight result)", i, r, results[0])
+		}
+	}
+}
+
+// TestDefaultImageURLUploadsThroughStore guards against StoryImage ever
+// being a bare local filename: the fallback used when Gemini is unavailable
+// must go through the configured ImageStore just like a generated image
+// does, so it's still fetchable once published to a remote webhook.
+func TestDefaultImageURLUploadsThroughStore(t *testing.T) {
+	chdirTemp(t)
+	if err := os.Mkdir(imageDir, 0755); err != nil {
+		t.Fatalf("Mkdir imageDir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(imageDir, defaultImage), []byte("fallback pixels"), 0644); err != nil {
+		t.Fatalf("write local default asset: %v", err)
+	}
+
+	store := &countingStore{inner: &LocalDirStore{Dir: t.TempDir()}}
+	feed := &HackerNewsFeed{imageStore: store}
+
+	url := feed.defaultImageURL(context.Background())
+	if url == defaultImage {
+		t.Fatalf("defaultImageURL returned the bare local filename %q, want a store-backed URL", url)
+	}
+	if store.puts != 1 {
+		t.Errorf("image store Put called %d times, want 1", store.puts)
+	}
+
+	// A second call must reuse the cached URL, not upload again.
+	if again := feed.defaultImageURL(context.Background()); again != url {
+		t.Errorf("second defaultImageURL call returned %q, want cached %q", again, url)
+	}
+	if store.puts != 1 {
+		t.Errorf("image store Put called %d times after a second call, want still 1", store.puts)
+	}
+}
+
+// testPipelineConfig returns a small, fast ImagePipelineConfig for tests
+// that need to run the real e-ink pipeline but don't care about TRMNL's
+// native panel dimensions.
+func testPipelineConfig() ImagePipelineConfig {
+	return ImagePipelineConfig{
+		PanelWidth:  16,
+		PanelHeight: 16,
+		DitherAlgo:  defaultDitherAlgo,
+		Palette:     defaultPalette,
+		Format:      defaultFormat,
+	}
+}
+
+// TestReuseByTitleFindsSimilarStory covers the dedup shortcut Render relies
+// on to skip Gemini for "Show HN" reposts and reworded follow-ups: a
+// similar-enough title with an image still in the store must short-circuit
+// to that image's URL.
+func TestReuseByTitleFindsSimilarStory(t *testing.T) {
+	dir := t.TempDir()
+	store := &LocalDirStore{Dir: dir}
+	cfg := testPipelineConfig()
+
+	if _, err := store.Put(context.Background(), "1."+cfg.Format, mimeForFormat(cfg.Format), bytes.NewReader([]byte("pixels"))); err != nil {
+		t.Fatalf("seed store: %v", err)
+	}
+
+	idx := &HashIndex{path: filepath.Join(dir, "hashindex.db")}
+	idx.rebuildBuckets()
+	if err := idx.Add(HashEntry{CacheID: 1, Title: "Show HN: My new database"}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	feed := &HackerNewsFeed{
+		imageStore:    store,
+		hashIndex:     idx,
+		imagePipeline: NewImagePipeline(cfg),
+		dedupCfg:      DedupConfig{TitleSim: 0.5, PHashDist: defaultDedupPHashDist},
+	}
+
+	url, ok := feed.reuseByTitle(context.Background(), "Show HN: My new database (update)")
+	if !ok {
+		t.Fatal("reuseByTitle = false, want true for a near-duplicate title")
+	}
+	wantURL, _ := store.Exists(context.Background(), "1."+cfg.Format)
+	if url != wantURL {
+		t.Errorf("reuseByTitle URL = %q, want %q", url, wantURL)
+	}
+
+	if _, ok := feed.reuseByTitle(context.Background(), "The history of the bicycle"); ok {
+		t.Error("reuseByTitle = true for an unrelated title, want false")
+	}
+}
+
+// TestFinishGenerationReusesNearDuplicateImage covers the other half of the
+// dedup request: a freshly generated image whose pHash is a near-duplicate
+// of one already indexed should reuse that image's URL instead of running
+// the e-ink pipeline and uploading again.
+func TestFinishGenerationReusesNearDuplicateImage(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testPipelineConfig()
+	store := &countingStore{inner: &LocalDirStore{Dir: dir}}
+	idx := &HashIndex{path: filepath.Join(dir, "hashindex.db")}
+	idx.rebuildBuckets()
+
+	feed := &HackerNewsFeed{
+		imageStore:    store,
+		hashIndex:     idx,
+		imagePipeline: NewImagePipeline(cfg),
+		dedupCfg:      DedupConfig{TitleSim: defaultDedupTitleSim, PHashDist: defaultDedupPHashDist},
+	}
+
+	raw := encodePNG(t, solidImage(64, 64, color.RGBA{R: 80, G: 120, B: 200, A: 255}))
+
+	firstImageID := fmt.Sprintf("1.%s", cfg.Format)
+	firstURL, err := feed.finishGeneration(context.Background(), raw, "First story", 1, firstImageID, filepath.Join(dir, "1.meta.json"))
+	if err != nil {
+		t.Fatalf("finishGeneration (first): %v", err)
+	}
+	if store.puts != 1 {
+		t.Fatalf("image store Put called %d times after the first generation, want 1", store.puts)
+	}
+	if len(idx.Entries) != 1 {
+		t.Fatalf("hash index has %d entries after the first generation, want 1", len(idx.Entries))
+	}
+
+	secondImageID := fmt.Sprintf("2.%s", cfg.Format)
+	secondURL, err := feed.finishGeneration(context.Background(), raw, "Second story, same art", 2, secondImageID, filepath.Join(dir, "2.meta.json"))
+	if err != nil {
+		t.Fatalf("finishGeneration (second): %v", err)
+	}
+
+	if secondURL != firstURL {
+		t.Errorf("finishGeneration for a pHash near-duplicate returned %q, want the reused URL %q", secondURL, firstURL)
+	}
+	if store.puts != 1 {
+		t.Errorf("image store Put called %d times after a near-duplicate generation, want still 1 (no new upload)", store.puts)
+	}
+	if len(idx.Entries) != 1 {
+		t.Errorf("hash index has %d entries after a reused generation, want still 1 (no new entry for a reuse)", len(idx.Entries))
+	}
+}
+
+// TestFinishGenerationFallsThroughWhenNoMatch ensures a genuinely distinct
+// image doesn't get wrongly deduped: it must run the full pipeline and add
+// its own hash index entry.
+func TestFinishGenerationFallsThroughWhenNoMatch(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testPipelineConfig()
+	store := &countingStore{inner: &LocalDirStore{Dir: dir}}
+	idx := &HashIndex{path: filepath.Join(dir, "hashindex.db")}
+	idx.rebuildBuckets()
+
+	feed := &HackerNewsFeed{
+		imageStore:    store,
+		hashIndex:     idx,
+		imagePipeline: NewImagePipeline(cfg),
+		dedupCfg:      DedupConfig{TitleSim: defaultDedupTitleSim, PHashDist: defaultDedupPHashDist},
+	}
+
+	firstRaw := encodePNG(t, solidImage(64, 64, color.RGBA{R: 80, G: 120, B: 200, A: 255}))
+	if _, err := feed.finishGeneration(context.Background(), firstRaw, "First story", 1, fmt.Sprintf("1.%s", cfg.Format), filepath.Join(dir, "1.meta.json")); err != nil {
+		t.Fatalf("finishGeneration (first): %v", err)
+	}
+
+	secondRaw := encodePNG(t, checkerImage(64, 64))
+	secondURL, err := feed.finishGeneration(context.Background(), secondRaw, "Unrelated story", 2, fmt.Sprintf("2.%s", cfg.Format), filepath.Join(dir, "2.meta.json"))
+	if err != nil {
+		t.Fatalf("finishGeneration (second): %v", err)
+	}
+
+	if store.puts != 2 {
+		t.Errorf("image store Put called %d times for two visually distinct images, want 2", store.puts)
+	}
+	if len(idx.Entries) != 2 {
+		t.Errorf("hash index has %d entries for two visually distinct images, want 2", len(idx.Entries))
+	}
+	wantURL, _ := store.Exists(context.Background(), fmt.Sprintf("2.%s", cfg.Format))
+	if secondURL != wantURL {
+		t.Errorf("finishGeneration (second) URL = %q, want %q", secondURL, wantURL)
+	}
+}
+
+// failingStore always fails Put, so tests can exercise defaultImageURL's
+// error path without a real broken backend.
+type failingStore struct{}
+
+func (failingStore) Put(ctx context.Context, id, mime string, r io.Reader) (string, error) {
+	return "", fmt.Errorf("simulated store outage")
+}
+
+func (failingStore) Exists(ctx context.Context, id string) (string, bool) { return "", false }
+
+// TestDefaultImageURLRetriesAfterFailure ensures a transient store outage on
+// the first fallback doesn't wedge every later fallback onto the bare local
+// filename for the rest of the process's life: once the store recovers, the
+// next call should succeed and cache the real URL.
+func TestDefaultImageURLRetriesAfterFailure(t *testing.T) {
+	chdirTemp(t)
+	if err := os.Mkdir(imageDir, 0755); err != nil {
+		t.Fatalf("Mkdir imageDir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(imageDir, defaultImage), []byte("fallback pixels"), 0644); err != nil {
+		t.Fatalf("write local default asset: %v", err)
+	}
+
+	feed := &HackerNewsFeed{imageStore: failingStore{}}
+
+	if url := feed.defaultImageURL(context.Background()); url != defaultImage {
+		t.Fatalf("defaultImageURL during outage = %q, want bare filename %q", url, defaultImage)
+	}
+
+	store := &countingStore{inner: &LocalDirStore{Dir: t.TempDir()}}
+	feed.imageStore = store
+
+	url := feed.defaultImageURL(context.Background())
+	if url == defaultImage {
+		t.Fatalf("defaultImageURL after recovery = %q, want a store-backed URL", url)
+	}
+	if store.puts != 1 {
+		t.Errorf("image store Put called %d times after recovery, want 1", store.puts)
+	}
+}
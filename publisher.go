@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WebhookData is the envelope TRMNL's plugin webhook expects its payload
+// wrapped in.
+type WebhookData struct {
+	MergeVariables Response `json:"merge_variables"`
+}
+
+const (
+	defaultMaxPayloadBytes = 2_000_000
+	publishMaxAttempts     = 5
+	publishMaxBackoff      = 30 * time.Second
+)
+
+// Publisher posts a Response to TRMNL's webhook, signing the payload,
+// retrying on transient failures, and splitting it if it's too large for a
+// single merge-variable payload.
+type Publisher struct {
+	webhookURL      string
+	secret          string
+	httpClient      *http.Client
+	maxPayloadBytes int
+	lastPublishPath string
+	sleep           func(ctx context.Context, attempt int) error
+}
+
+// NewPublisher builds a Publisher for webhookURL, signing payloads with
+// secret. maxPayloadBytes defaults to TRMNL_MAX_PAYLOAD_BYTES, or a
+// conservative built-in default.
+func NewPublisher(webhookURL, secret string) *Publisher {
+	maxPayloadBytes := defaultMaxPayloadBytes
+	if v := os.Getenv("TRMNL_MAX_PAYLOAD_BYTES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			maxPayloadBytes = n
+		}
+	}
+
+	return &Publisher{
+		webhookURL:      webhookURL,
+		secret:          secret,
+		httpClient:      &http.Client{Timeout: 30 * time.Second},
+		maxPayloadBytes: maxPayloadBytes,
+		lastPublishPath: filepath.Join(cacheDir, "last_publish.json"),
+		sleep:           sleepWithBackoff,
+	}
+}
+
+// lastPublishRecord is written to lastPublishPath after a successful
+// publish, so DryRun can diff against the last thing that actually went out.
+type lastPublishRecord struct {
+	PublishedAt string          `json:"publishedAt"`
+	StatusCode  int             `json:"statusCode"`
+	Response    string          `json:"response"`
+	Payload     json.RawMessage `json:"payload"`
+}
+
+// Publish sends resp to the webhook, splitting it into multiple sequential
+// posts if it doesn't fit in a single merge-variable payload.
+func (p *Publisher) Publish(ctx context.Context, resp Response) error {
+	if p.webhookURL == "" {
+		return fmt.Errorf("TRMNL_WEBHOOK_URL not set")
+	}
+
+	payloads := p.preparePayloads(resp)
+	var statusCode int
+	var body string
+	for i, payload := range payloads {
+		if len(payloads) > 1 {
+			payload.Metadata.Chunk = i + 1
+			payload.Metadata.TotalChunks = len(payloads)
+		}
+
+		var err error
+		statusCode, body, err = p.postWithRetry(ctx, payload)
+		if err != nil {
+			return fmt.Errorf("publish chunk %d/%d: %w", i+1, len(payloads), err)
+		}
+	}
+
+	payloadJSON, err := json.Marshal(WebhookData{MergeVariables: resp})
+	if err != nil {
+		return fmt.Errorf("marshal payload for last-publish record: %w", err)
+	}
+
+	return p.recordSuccess(statusCode, body, payloadJSON)
+}
+
+// DryRun reports how resp's payload would differ from the last thing
+// actually published, without sending anything to the webhook.
+func (p *Publisher) DryRun(resp Response) (string, error) {
+	newJSON, err := json.MarshalIndent(WebhookData{MergeVariables: resp}, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("marshal payload: %w", err)
+	}
+
+	prevData, err := os.ReadFile(p.lastPublishPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			payloads := p.preparePayloads(resp)
+			return fmt.Sprintf("no previous publish recorded at %s; would send %d payload(s)\n%s", p.lastPublishPath, len(payloads), newJSON), nil
+		}
+		return "", fmt.Errorf("read %s: %w", p.lastPublishPath, err)
+	}
+
+	var prev lastPublishRecord
+	if err := json.Unmarshal(prevData, &prev); err != nil {
+		return "", fmt.Errorf("parse %s: %w", p.lastPublishPath, err)
+	}
+
+	var prevPretty bytes.Buffer
+	if err := json.Indent(&prevPretty, prev.Payload, "", "  "); err != nil {
+		return "", fmt.Errorf("indent previous payload: %w", err)
+	}
+
+	diff := diffLines(prevPretty.String(), string(newJSON))
+	if diff == "" {
+		return fmt.Sprintf("no changes since last publish (%s)", prev.PublishedAt), nil
+	}
+	return diff, nil
+}
+
+// diffLines returns a unified-style line diff of a and b: lines only in a
+// are prefixed "-", lines only in b are prefixed "+", matched lines are
+// omitted. It's a minimal line-level diff, not a byte-level one.
+func diffLines(a, b string) string {
+	aLines := strings.Split(a, "\n")
+	bLines := strings.Split(b, "\n")
+
+	// lcs[i][j] = length of the longest common subsequence of aLines[i:]
+	// and bLines[j:].
+	lcs := make([][]int, len(aLines)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bLines)+1)
+	}
+	for i := len(aLines) - 1; i >= 0; i-- {
+		for j := len(bLines) - 1; j >= 0; j-- {
+			if aLines[i] == bLines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var out strings.Builder
+	i, j := 0, 0
+	for i < len(aLines) && j < len(bLines) {
+		switch {
+		case aLines[i] == bLines[j]:
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			fmt.Fprintf(&out, "-%s\n", aLines[i])
+			i++
+		default:
+			fmt.Fprintf(&out, "+%s\n", bLines[j])
+			j++
+		}
+	}
+	for ; i < len(aLines); i++ {
+		fmt.Fprintf(&out, "-%s\n", aLines[i])
+	}
+	for ; j < len(bLines); j++ {
+		fmt.Fprintf(&out, "+%s\n", bLines[j])
+	}
+
+	return out.String()
+}
+
+// preparePayloads returns resp as-is if it fits in a single payload.
+// Otherwise it first drops StoryImage from the lowest-scored stories until
+// it fits, and failing that, splits the stories across multiple sequential
+// payloads.
+func (p *Publisher) preparePayloads(resp Response) []Response {
+	if p.fits(resp) {
+		return []Response{resp}
+	}
+
+	trimmed := resp
+	trimmed.Stories = append([]FormattedStory(nil), resp.Stories...)
+
+	byAscendingScore := make([]int, len(trimmed.Stories))
+	for i := range byAscendingScore {
+		byAscendingScore[i] = i
+	}
+	sort.Slice(byAscendingScore, func(i, j int) bool {
+		return trimmed.Stories[byAscendingScore[i]].StoryScore < trimmed.Stories[byAscendingScore[j]].StoryScore
+	})
+
+	for _, idx := range byAscendingScore {
+		if p.fits(trimmed) {
+			break
+		}
+		trimmed.Stories[idx].StoryImage = ""
+	}
+
+	if p.fits(trimmed) {
+		return []Response{trimmed}
+	}
+
+	return p.splitIntoChunks(trimmed)
+}
+
+// splitIntoChunks recursively halves resp's stories until every resulting
+// payload fits in maxPayloadBytes.
+func (p *Publisher) splitIntoChunks(resp Response) []Response {
+	if p.fits(resp) || len(resp.Stories) <= 1 {
+		return []Response{resp}
+	}
+
+	mid := len(resp.Stories) / 2
+
+	left := resp
+	left.Stories = append([]FormattedStory(nil), resp.Stories[:mid]...)
+	left.Metadata.TotalCount = len(left.Stories)
+
+	right := resp
+	right.Stories = append([]FormattedStory(nil), resp.Stories[mid:]...)
+	right.Metadata.TotalCount = len(right.Stories)
+
+	return append(p.splitIntoChunks(left), p.splitIntoChunks(right)...)
+}
+
+func (p *Publisher) fits(resp Response) bool {
+	data, err := json.Marshal(WebhookData{MergeVariables: resp})
+	if err != nil {
+		return false
+	}
+	return len(data) <= p.maxPayloadBytes
+}
+
+// postWithRetry posts a single payload, retrying 5xx responses and network
+// errors with exponential backoff and jitter.
+func (p *Publisher) postWithRetry(ctx context.Context, resp Response) (int, string, error) {
+	jsonData, err := json.Marshal(WebhookData{MergeVariables: resp})
+	if err != nil {
+		return 0, "", fmt.Errorf("marshal payload: %w", err)
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < publishMaxAttempts; attempt++ {
+		if attempt > 0 {
+			if err := p.sleep(ctx, attempt); err != nil {
+				return 0, "", err
+			}
+		}
+
+		statusCode, body, err := p.post(ctx, jsonData)
+		if err != nil {
+			lastErr = err
+			log.Printf("Webhook post failed (attempt %d/%d): %v", attempt+1, publishMaxAttempts, err)
+			continue
+		}
+
+		if statusCode >= 500 {
+			lastErr = fmt.Errorf("status %d: %s", statusCode, body)
+			log.Printf("Webhook post failed (attempt %d/%d): %v", attempt+1, publishMaxAttempts, lastErr)
+			continue
+		}
+
+		if statusCode >= 400 {
+			return 0, "", fmt.Errorf("webhook returned status %d: %s", statusCode, body)
+		}
+
+		return statusCode, body, nil
+	}
+
+	return 0, "", fmt.Errorf("giving up after %d attempts: %w", publishMaxAttempts, lastErr)
+}
+
+func sleepWithBackoff(ctx context.Context, attempt int) error {
+	backoff := time.Duration(1<<uint(attempt-1)) * time.Second
+	if backoff > publishMaxBackoff {
+		backoff = publishMaxBackoff
+	}
+	jitter := time.Duration(rand.Int63n(int64(backoff/2 + 1)))
+
+	select {
+	case <-time.After(backoff + jitter):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// post signs jsonData and sends it as a single HTTP request.
+func (p *Publisher) post(ctx context.Context, jsonData []byte) (int, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.webhookURL, bytes.NewReader(jsonData))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	req.Header.Set("X-TRMNL-Timestamp", timestamp)
+	if p.secret != "" {
+		req.Header.Set("X-TRMNL-Signature", signPayload(p.secret, timestamp, jsonData))
+	} else {
+		log.Println("TRMNL_WEBHOOK_SECRET not set, posting unsigned webhook")
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, "", err
+	}
+
+	return resp.StatusCode, string(body), nil
+}
+
+// signPayload HMAC-SHA256 signs timestamp+body so TRMNL can verify the
+// request came from us and reject replays outside its timestamp window.
+func signPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// recordSuccess writes the last successful publish to disk so DryRun can
+// diff against it.
+func (p *Publisher) recordSuccess(statusCode int, body string, payload json.RawMessage) error {
+	record := lastPublishRecord{
+		PublishedAt: time.Now().UTC().Format(time.RFC3339),
+		StatusCode:  statusCode,
+		Response:    body,
+		Payload:     payload,
+	}
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(p.lastPublishPath, data, 0644)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func noSleep(ctx context.Context, attempt int) error { return nil }
+
+func testResponse(n int) Response {
+	stories := make([]FormattedStory, n)
+	for i := range stories {
+		stories[i] = FormattedStory{
+			StoryTitle: "Story", StoryURL: "https://example.com", StoryImage: "https://example.com/1.png",
+			StoryTimestamp: "Jan 1, 2026", StoryID: i, StoryScore: i,
+		}
+	}
+	return Response{Stories: stories, Metadata: Metadata{TotalCount: n, LastUpdated: "2026-01-01T00:00:00Z", Version: "1.0"}}
+}
+
+func newTestPublisher(t *testing.T, url string) *Publisher {
+	t.Helper()
+	dir := t.TempDir()
+	p := NewPublisher(url, "")
+	p.lastPublishPath = filepath.Join(dir, "last_publish.json")
+	p.sleep = noSleep
+	return p
+}
+
+func TestPostWithRetryGivesUpAfterMaxAttempts(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	p := newTestPublisher(t, server.URL)
+
+	err := p.Publish(context.Background(), testResponse(1))
+	if err == nil {
+		t.Fatal("Publish returned nil error for a persistently failing webhook")
+	}
+	if !strings.Contains(err.Error(), "giving up after 5 attempts") {
+		t.Errorf("error = %q, want it to mention giving up after 5 attempts", err)
+	}
+	if got := atomic.LoadInt32(&attempts); got != publishMaxAttempts {
+		t.Errorf("server received %d requests, want %d", got, publishMaxAttempts)
+	}
+}
+
+func TestPostWithRetryStopsOnClientError(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	p := newTestPublisher(t, server.URL)
+
+	if err := p.Publish(context.Background(), testResponse(1)); err == nil {
+		t.Fatal("Publish returned nil error for a 400 response")
+	}
+	if got := atomic.LoadInt32(&attempts); got != 1 {
+		t.Errorf("server received %d requests, want 1 (no retry on 4xx)", got)
+	}
+}
+
+func TestPostWithRetrySucceedsAfterTransientFailures(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	p := newTestPublisher(t, server.URL)
+
+	if err := p.Publish(context.Background(), testResponse(1)); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if got := atomic.LoadInt32(&attempts); got != 3 {
+		t.Errorf("server received %d requests, want 3", got)
+	}
+}
+
+func TestPreparePayloadsSplitsOversizedResponse(t *testing.T) {
+	p := newTestPublisher(t, "https://example.invalid")
+	p.maxPayloadBytes = 600
+
+	resp := testResponse(10)
+	payloads := p.preparePayloads(resp)
+
+	if len(payloads) < 2 {
+		t.Fatalf("got %d payload(s), want split into multiple chunks", len(payloads))
+	}
+
+	var totalStories int
+	for i, payload := range payloads {
+		data, err := json.Marshal(WebhookData{MergeVariables: payload})
+		if err != nil {
+			t.Fatalf("marshal payload %d: %v", i, err)
+		}
+		if len(data) > p.maxPayloadBytes {
+			t.Errorf("payload %d is %d bytes, want <= %d", i, len(data), p.maxPayloadBytes)
+		}
+		totalStories += len(payload.Stories)
+	}
+
+	if totalStories != len(resp.Stories) {
+		t.Errorf("split payloads contain %d stories total, want %d", totalStories, len(resp.Stories))
+	}
+}
+
+func TestPublishSetsChunkMetadataOnSplitPayloads(t *testing.T) {
+	var bodies [][]byte
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			MergeVariables Response `json:"merge_variables"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err == nil {
+			mu.Lock()
+			bodies = append(bodies, []byte(body.MergeVariables.Metadata.LastUpdated))
+			mu.Unlock()
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	p := newTestPublisher(t, server.URL)
+	p.maxPayloadBytes = 600
+
+	if err := p.Publish(context.Background(), testResponse(10)); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	mu.Lock()
+	n := len(bodies)
+	mu.Unlock()
+	if n < 2 {
+		t.Fatalf("webhook received %d post(s), want multiple chunks", n)
+	}
+}
+
+func TestSignPayloadMatchesDocumentedHMACScheme(t *testing.T) {
+	secret := "shh"
+	timestamp := "2026-01-01T00:00:00Z"
+	body := []byte(`{"hello":"world"}`)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write(body)
+	want := hex.EncodeToString(mac.Sum(nil))
+
+	if got := signPayload(secret, timestamp, body); got != want {
+		t.Errorf("signPayload = %q, want %q", got, want)
+	}
+}
+
+func TestPostSetsSignatureAndTimestampHeaders(t *testing.T) {
+	var gotSig, gotTimestamp string
+	var gotBody []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSig = r.Header.Get("X-TRMNL-Signature")
+		gotTimestamp = r.Header.Get("X-TRMNL-Timestamp")
+		gotBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	p := NewPublisher(server.URL, "my-secret")
+	p.sleep = noSleep
+
+	statusCode, _, err := p.post(context.Background(), []byte(`{"a":1}`))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	if statusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", statusCode)
+	}
+
+	if gotTimestamp == "" {
+		t.Error("X-TRMNL-Timestamp header not set")
+	}
+	want := signPayload("my-secret", gotTimestamp, gotBody)
+	if gotSig != want {
+		t.Errorf("X-TRMNL-Signature = %q, want %q", gotSig, want)
+	}
+}
+
+func TestDryRunWithNoPreviousPublish(t *testing.T) {
+	p := newTestPublisher(t, "https://example.invalid")
+
+	diff, err := p.DryRun(testResponse(1))
+	if err != nil {
+		t.Fatalf("DryRun: %v", err)
+	}
+	if !strings.Contains(diff, "no previous publish recorded") {
+		t.Errorf("diff = %q, want it to note no previous publish", diff)
+	}
+}
+
+func TestDryRunDiffsAgainstLastPublish(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	p := newTestPublisher(t, server.URL)
+
+	first := testResponse(1)
+	if err := p.Publish(context.Background(), first); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	second := testResponse(1)
+	second.Stories[0].StoryTitle = "A brand new headline"
+
+	diff, err := p.DryRun(second)
+	if err != nil {
+		t.Fatalf("DryRun: %v", err)
+	}
+	if !strings.Contains(diff, "A brand new headline") {
+		t.Errorf("diff = %q, want it to mention the changed title", diff)
+	}
+
+	if noChange, err := p.DryRun(first); err != nil || !strings.Contains(noChange, "no changes") {
+		t.Errorf("DryRun(unchanged) = (%q, %v), want a no-changes message", noChange, err)
+	}
+}